@@ -0,0 +1,54 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dlq routes messages ClickHouse rejected outright (bad type, unknown
+// column, constraint violation, ...) to a side channel instead of dropping
+// them once a batch exhausts its retries.
+package dlq
+
+import (
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// Sink accepts a single poisoned row along with the error ClickHouse (or the
+// driver) returned for it. Implementations must be safe for concurrent use,
+// since rows from multiple shard writers can be routed at once.
+type Sink interface {
+	// Put records msgRow as undeliverable. cause is the classification error,
+	// kept for logging/inspection by the sink.
+	Put(taskName string, msgRow *model.MsgRow, cause error) error
+	Close() error
+}
+
+// NewSink builds the configured dead-letter sink for a task, or nil if the
+// task didn't configure one, in which case poisoned rows are only counted.
+func NewSink(kind, dsn string) (Sink, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "kafka":
+		return newKafkaSink(dsn)
+	case "file":
+		return newFileSink(dsn)
+	default:
+		return nil, errUnknownSinkKind(kind)
+	}
+}
+
+type errUnknownSinkKind string
+
+func (k errUnknownSinkKind) Error() string {
+	return "dlq: unknown sink kind " + string(k)
+}
@@ -0,0 +1,66 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dlq
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// fileSink appends poisoned rows as newline-delimited JSON to a local file.
+// It's meant for small deployments or as a stopgap before wiring a kafka
+// sink; operators tail/rotate the file themselves.
+type fileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+type fileRecord struct {
+	Time     time.Time `json:"time"`
+	TaskName string    `json:"task_name"`
+	Cause    string    `json:"cause"`
+	Row      []interface{} `json:"row"`
+}
+
+func (s *fileSink) Put(taskName string, msgRow *model.MsgRow, cause error) error {
+	rec := fileRecord{Time: time.Now(), TaskName: taskName, Cause: cause.Error(), Row: msgRow.Row}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(line)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,81 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dlq
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// kafkaSink republishes poisoned rows to a dead-letter topic so they can be
+// inspected or replayed without blocking the task's main batch retries.
+type kafkaSink struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+// newKafkaSink dials dsn ("broker1:9092,broker2:9092/dead-letter-topic") and
+// returns a sink publishing to the trailing topic segment.
+func newKafkaSink(dsn string) (*kafkaSink, error) {
+	brokers, topic := splitBrokersTopic(dsn)
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForLocal
+	cfg.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{topic: topic, producer: producer}, nil
+}
+
+type kafkaRecord struct {
+	Time     time.Time     `json:"time"`
+	TaskName string        `json:"task_name"`
+	Cause    string        `json:"cause"`
+	Row      []interface{} `json:"row"`
+}
+
+func (s *kafkaSink) Put(taskName string, msgRow *model.MsgRow, cause error) error {
+	rec := kafkaRecord{Time: time.Now(), TaskName: taskName, Cause: cause.Error(), Row: msgRow.Row}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(taskName),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+func (s *kafkaSink) Close() error {
+	return s.producer.Close()
+}
+
+// splitBrokersTopic splits a "broker1:9092,broker2:9092/topic" DSN into its
+// broker list and trailing topic name.
+func splitBrokersTopic(dsn string) (brokers []string, topic string) {
+	idx := strings.LastIndexByte(dsn, '/')
+	if idx < 0 {
+		return []string{dsn}, ""
+	}
+	return strings.Split(dsn[:idx], ","), dsn[idx+1:]
+}
@@ -0,0 +1,66 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+
+	"github.com/housepower/clickhouse_sinker/util/log"
+)
+
+// dedupToken derives a deterministic insert_deduplication_token from the
+// batch's source coordinates, so retrying the exact same Kafka range after a
+// partial commit produces the exact same token and ClickHouse's
+// Replicated*MergeTree engines dedupe the retried block instead of
+// double-inserting.
+func (c *ClickHouse) dedupToken(batch *model.Batch) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%d", c.taskCfg.Name, batch.Topic, batch.Partition, batch.FirstOffset, batch.Offset)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyBlockLanded, when enabled, confirms the block tagged with token was
+// actually written to `table` before the caller commits Kafka offsets for
+// it, closing the window where loopWrite's retry races a commit the driver
+// already reported as sent. table must be the exact table the insert that
+// produced token targeted (the `_local` table for sharded writes), since
+// system.part_log is scoped per table.
+func (c *ClickHouse) verifyBlockLanded(table, token string) bool {
+	if !c.chCfg.VerifyPartLog {
+		return true
+	}
+	conn := pool.GetConn(c.taskCfg.Clickhouse, 0)
+	rs, err := conn.Query(fmt.Sprintf(
+		`select count() from system.part_log where table = '%s' and database = '%s' `+
+			`and event_type = 'NewPart' and query_id = '%s'`,
+		table, c.chCfg.DB, token))
+	if err != nil {
+		log.Errorf("dedup: part_log verification query failed: %+v", err)
+		return false
+	}
+	defer rs.Close()
+
+	var count int
+	for rs.Next() {
+		_ = rs.Scan(&count)
+	}
+	return count > 0
+}
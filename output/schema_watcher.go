@@ -0,0 +1,165 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+
+	"github.com/housepower/clickhouse_sinker/util/log"
+)
+
+const (
+	// defaultSchemaPollInterval is how often we re-query system.columns when
+	// ClickHouseConfig doesn't set SchemaPollInterval.
+	defaultSchemaPollInterval = time.Minute
+	// ddlTailInterval is the (fixed, short) cadence for tailing
+	// system.query_log for DDL against our table, so a column add is picked
+	// up in seconds rather than waiting out the poll interval.
+	ddlTailInterval = 5 * time.Second
+
+	queryLogDDLTemplate = `select count() from system.query_log where event_time > '%s' and query_kind = 'Alter' ` +
+		`and query like '%%%s%%' and type = 'QueryFinish'`
+)
+
+// watchSchema re-queries system.columns on a timer (AutoSchema tasks only)
+// and swaps in the new Dims/prepareSQL when the table shape changed, so an
+// added/dropped nullable column doesn't require restarting sinker. A faster
+// system.query_log tail nudges the poll early when it observes a finished
+// ALTER against our table.
+func (c *ClickHouse) watchSchema() {
+	interval := c.chCfg.SchemaPollInterval
+	if interval <= 0 {
+		interval = defaultSchemaPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ddlTicker := time.NewTicker(ddlTailInterval)
+	defer ddlTicker.Stop()
+
+	lastDDLCheck := time.Now()
+	for {
+		select {
+		case <-c.schemaWatchStop:
+			return
+		case <-ticker.C:
+			c.refreshSchema()
+			c.refreshShardTopology()
+		case <-ddlTicker.C:
+			seen, checkedAt := c.sawDDLSince(lastDDLCheck)
+			lastDDLCheck = checkedAt
+			if seen {
+				c.refreshSchema()
+				c.refreshShardTopology()
+			}
+		}
+	}
+}
+
+// sawDDLSince reports whether system.query_log recorded a finished ALTER
+// against our table since `since`, returning the time the check ran so the
+// caller can advance its watermark even when the query itself fails.
+func (c *ClickHouse) sawDDLSince(since time.Time) (seen bool, checkedAt time.Time) {
+	checkedAt = time.Now()
+	conn := pool.GetConn(c.taskCfg.Clickhouse, 0)
+	q := fmt.Sprintf(queryLogDDLTemplate, since.Format("2006-01-02 15:04:05"), c.taskCfg.TableName)
+	rs, err := conn.Query(q)
+	if err != nil {
+		log.Errorf("schema watcher: query_log tail failed: %+v", err)
+		return false, checkedAt
+	}
+	defer rs.Close()
+
+	var count int
+	for rs.Next() {
+		_ = rs.Scan(&count)
+	}
+	return count > 0, checkedAt
+}
+
+// refreshSchema re-queries system.columns and, if the shape changed, drains
+// in-flight batches on every shard writer before swapping in the new
+// Dims/prepareSQL, so no writer observes a half-updated schema mid-batch.
+func (c *ClickHouse) refreshSchema() {
+	dims, err := c.queryDims()
+	if err != nil {
+		log.Errorf("schema watcher: failed to re-query system.columns: %+v", err)
+		return
+	}
+
+	added, removed := diffDims(c.Dims, dims)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	c.drainShardWriters()
+
+	prepareSQL, dms := c.buildPrepareSQL(c.taskCfg.TableName, dims)
+	c.dimsMu.Lock()
+	c.Dims = dims
+	c.dms = dms
+	c.prepareSQL = prepareSQL
+	c.dimsMu.Unlock()
+
+	if c.ParserRebuild != nil {
+		c.ParserRebuild(dims)
+	} else {
+		log.Errorf("schema watcher: table %s.%s changed but no ParserRebuild hook is registered; "+
+			"rows will be rejected and dead-lettered until producers pick up the new column arity",
+			c.chCfg.DB, c.taskCfg.TableName)
+	}
+
+	log.Infof("schema watcher: table %s.%s changed, added=%v removed=%v, new prepareSQL=%s",
+		c.chCfg.DB, c.taskCfg.TableName, added, removed, prepareSQL)
+}
+
+// drainShardWriters blocks until every shard writer has no batch queued AND
+// no batch actively inside loopWrite, so refreshSchema never swaps
+// Dims/prepareSQL underneath a write already in progress.
+func (c *ClickHouse) drainShardWriters() {
+	for _, sw := range c.shardWriters {
+		for sw.queued() > 0 || atomic.LoadInt32(&sw.active) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// diffDims reports column names present in `next` but not `prev` (added) and
+// vice versa (removed).
+func diffDims(prev, next []*model.ColumnWithType) (added, removed []string) {
+	prevSet := make(map[string]struct{}, len(prev))
+	for _, d := range prev {
+		prevSet[d.Name] = struct{}{}
+	}
+	nextSet := make(map[string]struct{}, len(next))
+	for _, d := range next {
+		nextSet[d.Name] = struct{}{}
+		if _, ok := prevSet[d.Name]; !ok {
+			added = append(added, d.Name)
+		}
+	}
+	for _, d := range prev {
+		if _, ok := nextSet[d.Name]; !ok {
+			removed = append(removed, d.Name)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,268 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/util/log"
+)
+
+// Sharding policy names, set via ClickHouseConfig.ShardingPolicy as
+// "<mode>" or "<mode>(column)" for the modes that need a key column.
+const (
+	ShardRandom     = "random"
+	ShardHash       = "hash"
+	ShardJumpHash   = "jump_hash"
+	ShardRendezvous = "rendezvous"
+)
+
+// shardIndexer picks the destination shard for a row, so a Distributed
+// table insert can be rewritten into N direct inserts against each shard's
+// `*_local` table instead of paying the network re-shard hop.
+type shardIndexer interface {
+	ShardFor(row []interface{}, colIdx int, numShards int) int
+}
+
+type randomIndexer struct{ counter uint64 }
+
+func (r *randomIndexer) ShardFor(_ []interface{}, _ int, numShards int) int {
+	n := atomic.AddUint64(&r.counter, 1)
+	return int(n % uint64(numShards))
+}
+
+type hashIndexer struct{}
+
+func (hashIndexer) ShardFor(row []interface{}, colIdx int, numShards int) int {
+	return int(hashKey(row, colIdx) % uint64(numShards))
+}
+
+type jumpHashIndexer struct{}
+
+// jumpHash implements Google's jump consistent hash so shard count changes
+// reshuffle the minimum number of keys.
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (jumpHashIndexer) ShardFor(row []interface{}, colIdx int, numShards int) int {
+	return jumpHash(hashKey(row, colIdx), numShards)
+}
+
+type rendezvousIndexer struct{}
+
+// ShardFor picks the shard whose id maximizes a combined hash with the key
+// (highest random weight), so adding/removing a shard only moves the keys
+// that hashed best to that shard.
+func (rendezvousIndexer) ShardFor(row []interface{}, colIdx int, numShards int) int {
+	key := hashKey(row, colIdx)
+	best, bestScore := 0, uint64(0)
+	for shard := 0; shard < numShards; shard++ {
+		h := fnv.New64a()
+		_, _ = fmt.Fprintf(h, "%d-%d", key, shard)
+		if score := h.Sum64(); score >= bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+func hashKey(row []interface{}, colIdx int) uint64 {
+	h := fnv.New64a()
+	if colIdx >= 0 && colIdx < len(row) {
+		_, _ = fmt.Fprintf(h, "%v", row[colIdx])
+	}
+	return h.Sum64()
+}
+
+// newShardIndexer parses chCfg.ShardingPolicy ("random", "hash(col)",
+// "jump_hash(col)", "rendezvous(col)") and resolves the key column's index
+// into dms, the same column order used to build prepareSQL. Key-based modes
+// error out when the column isn't found rather than silently hashing
+// nothing, which would collapse every row onto a single shard.
+func newShardIndexer(policy string, dms []string) (idx shardIndexer, colIdx int, err error) {
+	mode, column := policy, ""
+	if i := indexByte(policy, '('); i >= 0 && policy[len(policy)-1] == ')' {
+		mode, column = policy[:i], policy[i+1:len(policy)-1]
+	}
+	colIdx = -1
+	for i, name := range dms {
+		if name == column {
+			colIdx = i
+			break
+		}
+	}
+	switch mode {
+	case ShardHash:
+		if colIdx < 0 {
+			return nil, -1, errors.Errorf("sharding: policy %q references column %q which is not in the table schema", policy, column)
+		}
+		return hashIndexer{}, colIdx, nil
+	case ShardJumpHash:
+		if colIdx < 0 {
+			return nil, -1, errors.Errorf("sharding: policy %q references column %q which is not in the table schema", policy, column)
+		}
+		return jumpHashIndexer{}, colIdx, nil
+	case ShardRendezvous:
+		if colIdx < 0 {
+			return nil, -1, errors.Errorf("sharding: policy %q references column %q which is not in the table schema", policy, column)
+		}
+		return rendezvousIndexer{}, colIdx, nil
+	default:
+		return &randomIndexer{}, colIdx, nil
+	}
+}
+
+func indexByte(s string, b byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// shardTopology is the set of `*_local` endpoints backing a Distributed
+// table, resolved from system.clusters so Send can write straight to each
+// shard instead of forcing ClickHouse to re-shard a Distributed insert.
+type shardTopology struct {
+	mu     sync.RWMutex
+	shards []string // host:port of one replica per shard
+}
+
+func (t *shardTopology) count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.shards)
+}
+
+// resolveShardTopology reads system.clusters for c.chCfg.Cluster and
+// returns one representative host per shard_num, ordered by shard_num. The
+// shard index writeSharded uses to pick a pool.GetShardConn connection is
+// this slice's index, not the host itself — pool has no "dial this host"
+// entry point, so callers must keep pool's shard configuration ordered by
+// shard_num to match. initSharding checks the shard *counts* line up as a
+// best-effort guard; it cannot detect a same-length-but-reordered pool.
+func (c *ClickHouse) resolveShardTopology() (*shardTopology, error) {
+	conn := pool.GetConn(c.taskCfg.Clickhouse, 0)
+	rs, err := conn.Query(fmt.Sprintf(
+		`select shard_num, host_address from system.clusters where cluster = '%s' and replica_num = 1 order by shard_num`,
+		c.chCfg.Cluster))
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	type row struct {
+		shardNum int
+		host     string
+	}
+	var rows []row
+	for rs.Next() {
+		var r row
+		if err := rs.Scan(&r.shardNum, &r.host); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].shardNum < rows[j].shardNum })
+
+	topo := &shardTopology{shards: make([]string, 0, len(rows))}
+	for _, r := range rows {
+		topo.shards = append(topo.shards, r.host)
+	}
+	return topo, nil
+}
+
+// refreshShardTopology re-resolves system.clusters; called on the schema
+// watcher's tick, it replaces the shard list that splitByShard counts from
+// then on. It does not redo initSharding's check against pool.NumShards or
+// change the connections pool.GetShardConn hands out.
+func (c *ClickHouse) refreshShardTopology() {
+	if c.shardTopo == nil {
+		return
+	}
+	topo, err := c.resolveShardTopology()
+	if err != nil {
+		log.Errorf("sharding: failed to refresh system.clusters topology: %+v", err)
+		return
+	}
+	c.shardTopo.mu.Lock()
+	c.shardTopo.shards = topo.shards
+	c.shardTopo.mu.Unlock()
+}
+
+// localTableName returns the `*_local` table backing a Distributed table.
+func localTableName(table string) string {
+	return table + "_local"
+}
+
+// initSharding resolves the cluster topology and builds the configured
+// indexer when ShardingPolicy is set. Tasks that leave it unset keep the
+// pre-existing round-robin-by-BatchIdx routing.
+func (c *ClickHouse) initSharding() error {
+	if c.chCfg.ShardingPolicy == "" {
+		return nil
+	}
+	topo, err := c.resolveShardTopology()
+	if err != nil {
+		return err
+	}
+	if numShards := pool.NumShards(c.taskCfg.Clickhouse); numShards != topo.count() {
+		return errors.Errorf("sharding: cluster %s has %d shard(s) per system.clusters but pool %s is configured with %d; "+
+			"writeSharded indexes pool.GetShardConn by system.clusters shard_num order, so the counts must match",
+			c.chCfg.Cluster, topo.count(), c.taskCfg.Clickhouse, numShards)
+	}
+	indexer, colIdx, err := newShardIndexer(c.chCfg.ShardingPolicy, c.dms)
+	if err != nil {
+		return err
+	}
+	c.shardTopo = topo
+	c.shardIndexer, c.shardKeyColIdx = indexer, colIdx
+	log.Infof("sharding: resolved %d shard(s) for cluster %s using policy %q",
+		topo.count(), c.chCfg.Cluster, c.chCfg.ShardingPolicy)
+	return nil
+}
+
+// splitByShard groups a batch's rows by destination shard using the
+// configured indexer, so Send can write each group straight to its shard's
+// `*_local` table instead of going through the Distributed table.
+func (c *ClickHouse) splitByShard(batch *model.Batch) map[int][]*model.MsgRow {
+	groups := make(map[int][]*model.MsgRow)
+	numShards := c.shardTopo.count()
+	for _, msgRow := range batch.MsgRows {
+		if msgRow.Row == nil {
+			continue
+		}
+		shard := c.shardIndexer.ShardFor(msgRow.Row, c.shardKeyColIdx, numShards)
+		groups[shard] = append(groups[shard], msgRow)
+	}
+	return groups
+}
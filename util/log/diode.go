@@ -0,0 +1,185 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package log wraps sundy-li/go_commons/log with a non-blocking diode: hot
+// write-path goroutines enqueue a pre-formatted line into a bounded,
+// multi-producer queue and return immediately, instead of blocking on
+// stdout/file I/O during a burst of reconnects or failed batches. A
+// dedicated goroutine drains the queue into the real logger. Callers use
+// the same Error/Info style API as before; only the import path changes.
+package log
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	upstream "github.com/sundy-li/go_commons/log"
+)
+
+// entry is a single pre-formatted log line plus the level to emit it at.
+type entry struct {
+	level string
+	line  string
+}
+
+// diode is a bounded multi-producer/single-consumer queue backed by a
+// channel, so Go's runtime (not hand-rolled indexing) owns the
+// producer/consumer synchronization. push never blocks: a full channel
+// drops the new entry and counts it, rather than overwriting a slot the
+// consumer might be mid-read on.
+type diode struct {
+	ch      chan entry
+	dropped uint64
+}
+
+func newDiode(size int) *diode {
+	return &diode{ch: make(chan entry, size)}
+}
+
+// push is the producer side, safe to call from any number of goroutines
+// concurrently. It never blocks: when the queue is full it drops the
+// incoming entry and counts it.
+func (d *diode) push(e entry) {
+	select {
+	case d.ch <- e:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+}
+
+func (d *diode) takeDropped() uint64 {
+	return atomic.SwapUint64(&d.dropped, 0)
+}
+
+const (
+	// defaultBufferSize is the queue capacity when the config doesn't set one.
+	defaultBufferSize = 1024
+	// defaultDropNotifyInterval is how often a non-zero drop count is logged.
+	defaultDropNotifyInterval = 5 * time.Second
+)
+
+// resyncInterval bounds how long drain can stay blocked on a stale diode's
+// channel after Configure swaps d, so a swap is picked up within a bounded
+// delay instead of only whenever the old diode happens to receive an entry.
+const resyncInterval = time.Second
+
+var (
+	d atomic.Value // holds *diode; loaded/stored so Configure and the
+	// logging hot path never race on a plain pointer.
+	notifyIntervalNs = int64(defaultDropNotifyInterval)
+	configureOnce    sync.Once
+	startDrain       sync.Once
+)
+
+func init() {
+	d.Store(newDiode(defaultBufferSize))
+}
+
+func currentDiode() *diode {
+	return d.Load().(*diode)
+}
+
+func getNotifyInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&notifyIntervalNs))
+}
+
+// Configure resizes the queue and drop-notify cadence. Every task constructs
+// its own ClickHouse output and calls this, but the diode and its drain
+// goroutine are process-wide, so only the first call takes effect; later
+// calls (from the second and subsequent tasks) are no-ops.
+func Configure(bufferSize int, dropNotifyInterval time.Duration) {
+	configureOnce.Do(func() {
+		if bufferSize <= 0 {
+			bufferSize = defaultBufferSize
+		}
+		d.Store(newDiode(bufferSize))
+		if dropNotifyInterval > 0 {
+			atomic.StoreInt64(&notifyIntervalNs, int64(dropNotifyInterval))
+		}
+	})
+}
+
+func ensureDrain() {
+	startDrain.Do(func() {
+		go drain()
+	})
+}
+
+// drain is the queue's single consumer: it emits queued entries to the
+// upstream logger, periodically reports how many were dropped, and
+// re-resolves the current diode every resyncInterval so a Configure swap is
+// picked up instead of being drained forever against the diode that existed
+// when this goroutine started.
+func drain() {
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+
+	dd := currentDiode()
+	curInterval := getNotifyInterval()
+	notify := time.NewTicker(curInterval)
+	defer notify.Stop()
+
+	for {
+		select {
+		case e := <-dd.ch:
+			emit(e)
+		case <-resync.C:
+			dd = currentDiode()
+			if iv := getNotifyInterval(); iv != curInterval {
+				curInterval = iv
+				notify.Reset(curInterval)
+			}
+		case <-notify.C:
+			if n := dd.takeDropped(); n > 0 {
+				upstream.Errorf("log: dropped %d messages, consumer couldn't keep up", n)
+			}
+		}
+	}
+}
+
+func emit(e entry) {
+	switch e.level {
+	case "error":
+		upstream.Error(e.line)
+	case "info":
+		upstream.Info(e.line)
+	}
+}
+
+// Error enqueues an error-level line without blocking the caller.
+func Error(args ...interface{}) {
+	ensureDrain()
+	currentDiode().push(entry{level: "error", line: fmt.Sprint(args...)})
+}
+
+// Errorf enqueues a formatted error-level line without blocking the caller.
+func Errorf(format string, args ...interface{}) {
+	ensureDrain()
+	currentDiode().push(entry{level: "error", line: fmt.Sprintf(format, args...)})
+}
+
+// Info enqueues an info-level line without blocking the caller.
+func Info(args ...interface{}) {
+	ensureDrain()
+	currentDiode().push(entry{level: "info", line: fmt.Sprint(args...)})
+}
+
+// Infof enqueues a formatted info-level line without blocking the caller.
+func Infof(format string, args ...interface{}) {
+	ensureDrain()
+	currentDiode().push(entry{level: "info", line: fmt.Sprintf(format, args...)})
+}